@@ -3,15 +3,144 @@ package consul
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/agent/metadata"
 	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
 	autopilot "github.com/hashicorp/raft-autopilot"
 	"github.com/hashicorp/serf/serf"
 )
 
+// autopilotStateHistoryLen bounds the number of autopilot.State snapshots
+// retained for Server.AutopilotStateHistory.
+const autopilotStateHistoryLen = 16
+
+// AutopilotStateObserver is notified every time autopilot recomputes cluster
+// state. Subsystems that need to react to state transitions (a streaming
+// HTTP/gRPC endpoint, the health API, etc.) can register one instead of
+// polling the operator autopilot-state endpoint.
+type AutopilotStateObserver func(state *autopilot.State)
+
+// autopilotStateTracker holds the registered AutopilotStateObservers and the
+// ring buffer of recent autopilot.State snapshots backing
+// Server.AutopilotStateHistory. The zero value is ready to use: every field
+// is lazily initialized under lock, so no constructor is required.
+type autopilotStateTracker struct {
+	lock          sync.Mutex
+	observers     map[*AutopilotStateObserver]AutopilotStateObserver
+	history       []*autopilot.State
+	lastReconcile time.Time
+}
+
+// dueForReconcile reports whether at least interval has passed since the
+// last time it returned true, and advances the internal clock if so. It
+// throttles how often reconcileRaftServers runs from NotifyState.
+func (t *autopilotStateTracker) dueForReconcile(now time.Time, interval time.Duration) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if now.Sub(t.lastReconcile) < interval {
+		return false
+	}
+	t.lastReconcile = now
+	return true
+}
+
+// Server embeds an autopilotState field (declared alongside Server's other
+// fields) of type autopilotStateTracker. Its zero value is ready to use, so
+// no constructor step is needed to initialize it.
+
+// record appends state to the history ring buffer and notifies every
+// registered observer. Observers are copied out and invoked after the lock
+// is released, so a slow observer doesn't block other callers of
+// record/register/snapshot, and an observer that calls its own deregister
+// closure doesn't deadlock re-acquiring the lock. Each observer is invoked
+// with panic recovery so one misbehaving observer can't take down the
+// autopilot state-update loop that calls record.
+func (t *autopilotStateTracker) record(logger hclog.Logger, state *autopilot.State) {
+	t.lock.Lock()
+	t.history = append(t.history, state)
+	if len(t.history) > autopilotStateHistoryLen {
+		t.history = t.history[len(t.history)-autopilotStateHistoryLen:]
+	}
+
+	observers := make([]AutopilotStateObserver, 0, len(t.observers))
+	for _, observer := range t.observers {
+		observers = append(observers, observer)
+	}
+	t.lock.Unlock()
+
+	for _, observer := range observers {
+		invokeAutopilotStateObserver(logger, observer, state)
+	}
+}
+
+func invokeAutopilotStateObserver(logger hclog.Logger, observer AutopilotStateObserver, state *autopilot.State) {
+	defer func() {
+		if r := recover(); r != nil && logger != nil {
+			logger.Error("autopilot state observer panicked", "panic", r)
+		}
+	}()
+	observer(state)
+}
+
+func (t *autopilotStateTracker) snapshot() []*autopilot.State {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	history := make([]*autopilot.State, len(t.history))
+	copy(history, t.history)
+	return history
+}
+
+func (t *autopilotStateTracker) register(observer AutopilotStateObserver) func() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.observers == nil {
+		t.observers = make(map[*AutopilotStateObserver]AutopilotStateObserver)
+	}
+	key := &observer
+	t.observers[key] = observer
+
+	return func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.observers, key)
+	}
+}
+
+// RegisterAutopilotStateObserver registers fn to be called with every
+// autopilot.State computed going forward. The returned function deregisters
+// the observer.
+func (s *Server) RegisterAutopilotStateObserver(fn AutopilotStateObserver) func() {
+	return s.autopilotState.register(fn)
+}
+
+// AutopilotStateHistory returns up to the last autopilotStateHistoryLen
+// autopilot.State snapshots observed by this server, oldest first. It exists
+// to aid debugging of autopilot health transitions.
+func (s *Server) AutopilotStateHistory() []*autopilot.State {
+	return s.autopilotState.snapshot()
+}
+
+const (
+	// DefaultRedundancyZoneTag is the Serf tag (and node metadata key) that
+	// autopilotServer consults to populate AutopilotServerExt.RedundancyZone
+	// when the agent config does not override it.
+	DefaultRedundancyZoneTag = "ap_zone"
+
+	// DefaultUpgradeVersionTag is the Serf tag (and node metadata key) that
+	// autopilotServer consults to populate AutopilotServerExt.UpgradeVersion
+	// when the agent config does not override it.
+	DefaultUpgradeVersionTag = "ap_version"
+)
+
 type AutopilotServerExt struct {
 	ReadReplica    bool
 	RedundancyZone string
@@ -44,23 +173,158 @@ func (d *AutopilotDelegate) NotifyState(state *autopilot.State) {
 		} else {
 			metrics.SetGauge([]string{"autopilot", "healthy"}, 0)
 		}
+
+		for id, srv := range state.Servers {
+			emitAutopilotServerMetrics(id, srv, state)
+		}
+
+		if d.server.autopilotState.dueForReconcile(time.Now(), autopilotReconcileInterval) {
+			if err := d.server.reconcileRaftServers(); err != nil {
+				d.server.logger.Error("error reconciling raft configuration against autopilot servers", "error", err)
+			}
+		}
+	}
+
+	// fan out to registered observers and retain a short history regardless
+	// of leadership so non-leaders can still be inspected for debugging.
+	d.server.autopilotState.record(d.server.logger, state)
+}
+
+// emitAutopilotServerMetrics publishes per-server gauges so operators can
+// alert on individual servers/zones rather than only the cluster-wide
+// failure_tolerance/healthy gauges.
+func emitAutopilotServerMetrics(id raft.ServerID, srv *autopilot.ServerState, state *autopilot.State) {
+	var zone string
+	if ext, ok := srv.Server.Ext.(*AutopilotServerExt); ok {
+		zone = ext.RedundancyZone
+	}
+
+	isVoter := srv.State == autopilot.RaftVoter || srv.State == autopilot.RaftLeader
+	labels := []metrics.Label{
+		{Name: "server_id", Value: string(id)},
+		{Name: "zone", Value: zone},
+		{Name: "voter", Value: strconv.FormatBool(isVoter)},
+	}
+
+	healthy := float32(0)
+	if srv.Health.Healthy {
+		healthy = 1
+	}
+	metrics.SetGaugeWithLabels([]string{"autopilot", "server", "healthy"}, healthy, labels)
+	metrics.SetGaugeWithLabels([]string{"autopilot", "server", "last_contact"}, float32(srv.Health.LastContact.Milliseconds()), labels)
+	metrics.SetGaugeWithLabels([]string{"autopilot", "server", "stable_since"}, float32(time.Since(srv.Health.StableSince).Seconds()), labels)
+
+	if leader, ok := state.Servers[state.Leader]; ok {
+		lag := int64(leader.Health.LastIndex) - int64(srv.Health.LastIndex)
+		if lag < 0 {
+			lag = 0
+		}
+		metrics.SetGaugeWithLabels([]string{"autopilot", "server", "last_index_lag"}, float32(lag), labels)
 	}
 }
 
 func (d *AutopilotDelegate) RemoveFailedServer(srv *autopilot.Server) error {
-	if err := d.server.serfLAN.RemoveFailedNode(srv.Name); err != nil {
-		return fmt.Errorf("failed to remove server from the LAN serf instance: %w", err)
+	if serfMemberKnown(d.server.serfLAN.Members(), srv.Name) {
+		if err := d.server.serfLAN.RemoveFailedNode(srv.Name); err != nil {
+			return fmt.Errorf("failed to remove server from the LAN serf instance: %w", err)
+		}
+	} else {
+		// the node has already dropped out of the LAN member list entirely
+		// (e.g. it crashed before it could leave gracefully), so there's
+		// nothing left for RemoveFailedNode to do. It may still be a stale
+		// Raft peer though, so fall back to removing it directly from the
+		// Raft configuration by ID.
+		if err := d.server.raft.RemoveServer(srv.ID, 0, 0).Error(); err != nil {
+			return fmt.Errorf("failed to remove server %q from raft configuration by id: %w", srv.ID, err)
+		}
 	}
 
 	// the WAN serf instance has node names suffixed with .<datacenter> so when removing
 	// from there we need to ensure that we recreate the proper node name.
-	if err := d.server.serfWAN.RemoveFailedNode(srv.Name + "." + d.server.config.Datacenter); err != nil {
-		return fmt.Errorf("failed to remove server from the WAN serf instance: %w", err)
+	wanName := srv.Name + "." + d.server.config.Datacenter
+	if serfMemberKnown(d.server.serfWAN.Members(), wanName) {
+		if err := d.server.serfWAN.RemoveFailedNode(wanName); err != nil {
+			return fmt.Errorf("failed to remove server from the WAN serf instance: %w", err)
+		}
 	}
 
 	return d.enterpriseRemoveFailedServer(srv)
 }
 
+// serfMemberKnown reports whether name appears in members. It's used to
+// decide whether a Serf instance still has anything to clean up for a given
+// server, rather than inferring that from RemoveFailedNode's error text.
+func serfMemberKnown(members []serf.Member, name string) bool {
+	for _, m := range members {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// autopilotReconcileInterval is the minimum time between reconcileRaftServers
+// runs triggered from NotifyState.
+const autopilotReconcileInterval = time.Minute
+
+// reconcileRaftServers purges Raft peers that are absent from both Serf and
+// the catalog. This catches servers that dropped out of Serf without ever
+// being cleanly removed from Raft - the same stale-peer case that
+// AutopilotDelegate.RemoveFailedServer's by-ID fallback handles when
+// autopilot notices the failure directly. It is a no-op unless autopilot's
+// CleanupDeadServers setting is enabled.
+//
+// It's invoked periodically from NotifyState's leader-only branch (throttled
+// to autopilotReconcileInterval) rather than on its own ticker, so it only
+// runs while this server is leader - exactly when reconciling the Raft
+// configuration is safe and meaningful.
+func (s *Server) reconcileRaftServers() error {
+	if !s.getOrCreateAutopilotConfig().CleanupDeadServers {
+		return nil
+	}
+
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return fmt.Errorf("failed to get raft configuration: %w", err)
+	}
+
+	known := s.autopilotServers()
+
+	for _, raftSrv := range raftServersToRemove(future.Configuration().Servers, known) {
+		// a peer that Serf no longer lists but that is still registered in
+		// the catalog is left in place.
+		_, node, err := s.fsm.State().GetNodeID(types.NodeID(raftSrv.ID))
+		if err != nil {
+			return fmt.Errorf("error retrieving node from state store: %w", err)
+		}
+		if node != nil {
+			continue
+		}
+
+		s.logger.Warn("removing server from raft configuration because it is no longer in serf or the catalog",
+			"id", raftSrv.ID, "address", raftSrv.Address)
+
+		if err := s.raft.RemoveServer(raftSrv.ID, 0, 0).Error(); err != nil {
+			return fmt.Errorf("failed to remove raft peer %q: %w", raftSrv.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// raftServersToRemove returns the raftServers entries whose ID is absent
+// from known, i.e. peers that Raft still has configured but that Serf no
+// longer reports as servers. It does not consult the catalog.
+func raftServersToRemove(raftServers []raft.Server, known map[raft.ServerID]*autopilot.Server) []raft.Server {
+	var stale []raft.Server
+	for _, raftSrv := range raftServers {
+		if _, ok := known[raftSrv.ID]; !ok {
+			stale = append(stale, raftSrv)
+		}
+	}
+	return stale
+}
+
 func (s *Server) autopilotServers() map[raft.ServerID]*autopilot.Server {
 	servers := make(map[raft.ServerID]*autopilot.Server)
 	for _, member := range s.serfLAN.Members() {
@@ -85,10 +349,55 @@ func (s *Server) autopilotServer(m serf.Member) (*autopilot.Server, error) {
 		return nil, nil
 	}
 
-	return s.autopilotServerFromMetadata(srv)
+	zoneTag, versionTag := s.autopilotTagNames()
+	zone, upgradeVersion := resolveAutopilotTags(m.Tags, zoneTag, versionTag)
+
+	return s.autopilotServerFromMetadata(srv, zone, upgradeVersion)
+}
+
+// autopilotTagNames returns the Serf tag (and node metadata key) names used
+// to populate AutopilotServerExt.RedundancyZone/UpgradeVersion, preferring
+// the agent config overrides (RuntimeConfig.AutopilotRedundancyZoneTag/
+// AutopilotUpgradeVersionTag) and falling back to
+// DefaultRedundancyZoneTag/DefaultUpgradeVersionTag when unset.
+func (s *Server) autopilotTagNames() (zoneTag, versionTag string) {
+	zoneTag = s.config.AutopilotRedundancyZoneTag
+	if zoneTag == "" {
+		zoneTag = DefaultRedundancyZoneTag
+	}
+
+	versionTag = s.config.AutopilotUpgradeVersionTag
+	if versionTag == "" {
+		versionTag = DefaultUpgradeVersionTag
+	}
+
+	return zoneTag, versionTag
+}
+
+// resolveAutopilotTags extracts the redundancy-zone and upgrade-version
+// values from a Serf member's tags: zoneTag/versionTag first, falling back
+// to the legacy "redundancy_zone"/"upgrade_version" names used by other
+// raft-autopilot consumers. It's the pure core of autopilotServer's tag
+// lookup, split out so it can be tested without a *Server; catalog node meta
+// is handled by applyAutopilotMetaOverrides.
+func resolveAutopilotTags(tags map[string]string, zoneTag, versionTag string) (zone, upgradeVersion string) {
+	zone = firstNonEmptyTag(tags, zoneTag, "redundancy_zone")
+	upgradeVersion = firstNonEmptyTag(tags, versionTag, "upgrade_version")
+	return zone, upgradeVersion
+}
+
+// firstNonEmptyTag returns the value of the first of names present and
+// non-empty in tags, or the empty string if none match.
+func firstNonEmptyTag(tags map[string]string, names ...string) string {
+	for _, name := range names {
+		if v, ok := tags[name]; ok && v != "" {
+			return v
+		}
+	}
+	return ""
 }
 
-func (s *Server) autopilotServerFromMetadata(srv *metadata.Server) (*autopilot.Server, error) {
+func (s *Server) autopilotServerFromMetadata(srv *metadata.Server, zone, upgradeVersion string) (*autopilot.Server, error) {
 	server := &autopilot.Server{
 		Name:        srv.ShortName,
 		ID:          raft.ServerID(srv.ID),
@@ -96,7 +405,9 @@ func (s *Server) autopilotServerFromMetadata(srv *metadata.Server) (*autopilot.S
 		Version:     srv.Build,
 		RaftVersion: srv.RaftVersion,
 		Ext: &AutopilotServerExt{
-			ReadReplica: srv.NonVoter,
+			ReadReplica:    srv.NonVoter,
+			RedundancyZone: zone,
+			UpgradeVersion: upgradeVersion,
 		},
 	}
 
@@ -123,7 +434,25 @@ func (s *Server) autopilotServerFromMetadata(srv *metadata.Server) (*autopilot.S
 
 	if node != nil {
 		server.Meta = node.Meta
+
+		// catalog node meta takes precedence over stale Serf tags since it
+		// reflects the operator's most recently registered values.
+		zoneTag, versionTag := s.autopilotTagNames()
+		applyAutopilotMetaOverrides(server.Ext.(*AutopilotServerExt), node.Meta, zoneTag, versionTag)
 	}
 
 	return server, nil
 }
+
+// applyAutopilotMetaOverrides overwrites ext's RedundancyZone/UpgradeVersion
+// with values found in meta, if any are present. meta is typically catalog
+// node metadata, which is allowed to override the Serf tags autopilotServer
+// populated ext with initially.
+func applyAutopilotMetaOverrides(ext *AutopilotServerExt, meta map[string]string, zoneTag, versionTag string) {
+	if v := firstNonEmptyTag(meta, zoneTag, "redundancy_zone"); v != "" {
+		ext.RedundancyZone = v
+	}
+	if v := firstNonEmptyTag(meta, versionTag, "upgrade_version"); v != "" {
+		ext.UpgradeVersion = v
+	}
+}
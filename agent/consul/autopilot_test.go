@@ -0,0 +1,257 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	autopilot "github.com/hashicorp/raft-autopilot"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestFirstNonEmptyTag(t *testing.T) {
+	tags := map[string]string{
+		"redundancy_zone": "legacy-zone",
+		"ap_version":      "1.2.3",
+	}
+
+	if got := firstNonEmptyTag(tags, "ap_zone", "redundancy_zone"); got != "legacy-zone" {
+		t.Fatalf("expected fallback to legacy tag name, got %q", got)
+	}
+
+	if got := firstNonEmptyTag(tags, "ap_version", "upgrade_version"); got != "1.2.3" {
+		t.Fatalf("expected preferred tag name to win, got %q", got)
+	}
+
+	if got := firstNonEmptyTag(tags, "missing"); got != "" {
+		t.Fatalf("expected empty string for unmatched tag, got %q", got)
+	}
+}
+
+func TestResolveAutopilotTags(t *testing.T) {
+	cases := []struct {
+		name               string
+		tags               map[string]string
+		zoneTag            string
+		versionTag         string
+		wantZone           string
+		wantUpgradeVersion string
+	}{
+		{
+			name:               "configured tag names",
+			tags:               map[string]string{"ap_zone": "zone1", "ap_version": "1.9.0"},
+			zoneTag:            "ap_zone",
+			versionTag:         "ap_version",
+			wantZone:           "zone1",
+			wantUpgradeVersion: "1.9.0",
+		},
+		{
+			name:               "legacy tag names",
+			tags:               map[string]string{"redundancy_zone": "zone2", "upgrade_version": "1.10.0"},
+			zoneTag:            "ap_zone",
+			versionTag:         "ap_version",
+			wantZone:           "zone2",
+			wantUpgradeVersion: "1.10.0",
+		},
+		{
+			name:               "configured wins over legacy",
+			tags:               map[string]string{"ap_zone": "zone1", "redundancy_zone": "zone2"},
+			zoneTag:            "ap_zone",
+			versionTag:         "ap_version",
+			wantZone:           "zone1",
+			wantUpgradeVersion: "",
+		},
+		{
+			name:               "custom operator-configured tag name",
+			tags:               map[string]string{"my_zone": "zone3"},
+			zoneTag:            "my_zone",
+			versionTag:         "my_version",
+			wantZone:           "zone3",
+			wantUpgradeVersion: "",
+		},
+		{
+			name:               "no tags",
+			tags:               map[string]string{},
+			zoneTag:            "ap_zone",
+			versionTag:         "ap_version",
+			wantZone:           "",
+			wantUpgradeVersion: "",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			zone, upgradeVersion := resolveAutopilotTags(tc.tags, tc.zoneTag, tc.versionTag)
+			if zone != tc.wantZone {
+				t.Errorf("zone = %q, want %q", zone, tc.wantZone)
+			}
+			if upgradeVersion != tc.wantUpgradeVersion {
+				t.Errorf("upgradeVersion = %q, want %q", upgradeVersion, tc.wantUpgradeVersion)
+			}
+		})
+	}
+}
+
+func TestApplyAutopilotMetaOverrides(t *testing.T) {
+	ext := &AutopilotServerExt{
+		RedundancyZone: "serf-zone",
+		UpgradeVersion: "serf-version",
+	}
+
+	// empty catalog meta leaves the Serf-tag-derived values alone.
+	applyAutopilotMetaOverrides(ext, nil, "ap_zone", "ap_version")
+	if ext.RedundancyZone != "serf-zone" || ext.UpgradeVersion != "serf-version" {
+		t.Fatalf("nil meta should not change ext, got %+v", ext)
+	}
+
+	// catalog node meta overrides the Serf-tag-derived values when present.
+	applyAutopilotMetaOverrides(ext, map[string]string{
+		"ap_zone":    "catalog-zone",
+		"ap_version": "catalog-version",
+	}, "ap_zone", "ap_version")
+	if ext.RedundancyZone != "catalog-zone" {
+		t.Errorf("RedundancyZone = %q, want catalog-zone", ext.RedundancyZone)
+	}
+	if ext.UpgradeVersion != "catalog-version" {
+		t.Errorf("UpgradeVersion = %q, want catalog-version", ext.UpgradeVersion)
+	}
+
+	// a meta key that doesn't match anything leaves the prior value in place.
+	applyAutopilotMetaOverrides(ext, map[string]string{"unrelated": "x"}, "ap_zone", "ap_version")
+	if ext.RedundancyZone != "catalog-zone" || ext.UpgradeVersion != "catalog-version" {
+		t.Fatalf("unrelated meta should not change ext, got %+v", ext)
+	}
+}
+
+func TestSerfMemberKnown(t *testing.T) {
+	members := []serf.Member{
+		{Name: "node1"},
+		{Name: "node2"},
+	}
+
+	if !serfMemberKnown(members, "node1") {
+		t.Fatal("expected node1 to be known")
+	}
+	if serfMemberKnown(members, "node3") {
+		t.Fatal("expected node3, which isn't in members, to be unknown")
+	}
+	if serfMemberKnown(nil, "node1") {
+		t.Fatal("expected nil members to report nothing known")
+	}
+}
+
+// TestRaftServersToRemove simulates the scenario that motivates this
+// request: a server that has already departed Serf (and so is absent from
+// the known-servers map built from Serf/catalog) but is still present in the
+// Raft configuration.
+func TestRaftServersToRemove(t *testing.T) {
+	alive := raft.Server{ID: raft.ServerID("alive"), Address: raft.ServerAddress("127.0.0.1:8300")}
+	departed := raft.Server{ID: raft.ServerID("departed"), Address: raft.ServerAddress("127.0.0.2:8300")}
+
+	raftServers := []raft.Server{alive, departed}
+	known := map[raft.ServerID]*autopilot.Server{
+		alive.ID: {ID: alive.ID},
+		// "departed" dropped out of Serf and the catalog, so it's absent here
+		// even though Raft still lists it as a peer.
+	}
+
+	stale := raftServersToRemove(raftServers, known)
+	if len(stale) != 1 || stale[0].ID != departed.ID {
+		t.Fatalf("expected only %q to be stale, got %+v", departed.ID, stale)
+	}
+
+	// nothing to remove once every Raft peer is known.
+	known[departed.ID] = &autopilot.Server{ID: departed.ID}
+	if stale := raftServersToRemove(raftServers, known); len(stale) != 0 {
+		t.Fatalf("expected no stale servers, got %+v", stale)
+	}
+}
+
+func TestAutopilotStateTrackerDueForReconcile(t *testing.T) {
+	tr := &autopilotStateTracker{}
+	now := time.Unix(0, 0)
+
+	if !tr.dueForReconcile(now, time.Minute) {
+		t.Fatal("expected the first call to be due")
+	}
+	if tr.dueForReconcile(now.Add(30*time.Second), time.Minute) {
+		t.Fatal("expected a call within the interval to not be due")
+	}
+	if !tr.dueForReconcile(now.Add(time.Minute), time.Minute) {
+		t.Fatal("expected a call once the interval has elapsed to be due")
+	}
+}
+
+func TestAutopilotStateTrackerRegisterRecordSnapshot(t *testing.T) {
+	tr := &autopilotStateTracker{}
+
+	var got []*autopilot.State
+	unregister := tr.register(func(state *autopilot.State) {
+		got = append(got, state)
+	})
+
+	state1 := &autopilot.State{Healthy: true}
+	tr.record(nil, state1)
+
+	if len(got) != 1 || got[0] != state1 {
+		t.Fatalf("expected observer to be called with state1, got %+v", got)
+	}
+	if snap := tr.snapshot(); len(snap) != 1 || snap[0] != state1 {
+		t.Fatalf("expected snapshot to contain state1, got %+v", snap)
+	}
+
+	unregister()
+
+	state2 := &autopilot.State{Healthy: false}
+	tr.record(nil, state2)
+
+	if len(got) != 1 {
+		t.Fatalf("expected unregistered observer to not be called again, got %+v", got)
+	}
+	if snap := tr.snapshot(); len(snap) != 2 || snap[1] != state2 {
+		t.Fatalf("expected snapshot to include state2 after recording, got %+v", snap)
+	}
+}
+
+func TestAutopilotStateTrackerRecordTrimsHistory(t *testing.T) {
+	tr := &autopilotStateTracker{}
+	for i := 0; i < autopilotStateHistoryLen+5; i++ {
+		tr.record(nil, &autopilot.State{})
+	}
+	if got := len(tr.snapshot()); got != autopilotStateHistoryLen {
+		t.Fatalf("expected history capped at %d entries, got %d", autopilotStateHistoryLen, got)
+	}
+}
+
+// TestAutopilotStateTrackerRecordObserverCanDeregisterItself guards against
+// the record/register lock-reentrancy deadlock: an observer that calls its
+// own deregister closure must not block forever.
+func TestAutopilotStateTrackerRecordObserverCanDeregisterItself(t *testing.T) {
+	tr := &autopilotStateTracker{}
+
+	var unregister func()
+	calls := 0
+	unregister = tr.register(func(state *autopilot.State) {
+		calls++
+		unregister()
+	})
+
+	tr.record(nil, &autopilot.State{})
+	tr.record(nil, &autopilot.State{})
+
+	if calls != 1 {
+		t.Fatalf("expected the observer to run exactly once before deregistering itself, got %d", calls)
+	}
+}
+
+// TestAutopilotStateTrackerRecordRecoversObserverPanic guards against a
+// panicking observer taking down the caller of record (autopilot's own
+// state-update loop).
+func TestAutopilotStateTrackerRecordRecoversObserverPanic(t *testing.T) {
+	tr := &autopilotStateTracker{}
+	tr.register(func(state *autopilot.State) {
+		panic("boom")
+	})
+
+	tr.record(nil, &autopilot.State{})
+}